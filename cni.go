@@ -0,0 +1,155 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/containernetworking/cni/libcni"
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+const (
+	defaultCNIBinDir  = "/opt/cni/bin"
+	defaultCNIConfDir = "/etc/cni/net.d"
+	defaultCNIIfName  = "eth0"
+)
+
+var (
+	unknownCNIKey     = errors.New("unknown --cni-network key")
+	cniMissingNetwork = errors.New("--cni-network requires network=<name>")
+)
+
+// cniSpec is the decoded form of a --cni-network specification:
+// "network=<name>,ifname=<name>,binpath=<dir>,confdir=<dir>". Only
+// network is required; ifname/binpath/confdir fall back to the usual CNI
+// conventions.
+type cniSpec struct {
+	Network string
+	IfName  string
+	BinDir  string
+	ConfDir string
+}
+
+// parseCNISpec decodes a --cni-network specification.
+func parseCNISpec(cfg string) (cniSpec, error) {
+	fields, err := splitKV(cfg)
+	if err != nil {
+		return cniSpec{}, err
+	}
+
+	spec := cniSpec{IfName: defaultCNIIfName, BinDir: defaultCNIBinDir, ConfDir: defaultCNIConfDir}
+	for k, v := range fields {
+		switch k {
+		case "network":
+			spec.Network = v
+		case "ifname":
+			spec.IfName = v
+		case "binpath":
+			spec.BinDir = v
+		case "confdir":
+			spec.ConfDir = v
+		default:
+			return cniSpec{}, unknownCNIKey
+		}
+	}
+
+	if spec.Network == "" {
+		return cniSpec{}, cniMissingNetwork
+	}
+
+	return spec, nil
+}
+
+// cniTeardown is the io.Closer returned alongside a CNI-attached
+// NetworkInterface; it runs the matching CNI DEL so the bridge/ptp/macvlan
+// plugin can release whatever it set up for this VM.
+type cniTeardown struct {
+	cfg *libcni.CNIConfig
+	net *libcni.NetworkConfigList
+	rt  *libcni.RuntimeConf
+}
+
+func (c cniTeardown) Close() error {
+	return c.cfg.DelNetworkList(context.Background(), c.net, c.rt)
+}
+
+// runCNINetworkSetup invokes the CNI plugins described by spec for
+// containerID and turns the resulting libcni.Result into the
+// NetworkInterface firecracker should attach. It's the real
+// implementation behind the cniNetworkSetup var, which tests override
+// to avoid actually invoking CNI plugins.
+func runCNINetworkSetup(containerID string, spec cniSpec) (firecracker.NetworkInterface, io.Closer, error) {
+	cniConfig := libcni.NewCNIConfig([]string{spec.BinDir}, nil)
+
+	netConfList, err := libcni.LoadConfList(spec.ConfDir, spec.Network)
+	if err != nil {
+		return firecracker.NetworkInterface{}, nil, fmt.Errorf("loading CNI network %q: %v", spec.Network, err)
+	}
+
+	rt := &libcni.RuntimeConf{
+		ContainerID: containerID,
+		NetNS:       "/proc/self/ns/net",
+		IfName:      spec.IfName,
+	}
+
+	res, err := cniConfig.AddNetworkList(context.Background(), netConfList, rt)
+	if err != nil {
+		return firecracker.NetworkInterface{}, nil, fmt.Errorf("adding CNI network %q: %v", spec.Network, err)
+	}
+
+	result, err := current.GetResult(res)
+	if err != nil {
+		return firecracker.NetworkInterface{}, nil, fmt.Errorf("decoding CNI result for %q: %v", spec.Network, err)
+	}
+
+	hostDevName, mac := selectCNIResult(result.Interfaces, spec.IfName)
+	if hostDevName == "" || mac == "" {
+		cniConfig.DelNetworkList(context.Background(), netConfList, rt)
+		return firecracker.NetworkInterface{}, nil, fmt.Errorf("CNI network %q did not report both a host-side interface and guest interface %q", spec.Network, spec.IfName)
+	}
+
+	nic := firecracker.NetworkInterface{
+		HostDevName: hostDevName,
+		MacAddress:  mac,
+	}
+
+	return nic, cniTeardown{cfg: cniConfig, net: netConfList, rt: rt}, nil
+}
+
+// cniNetworkSetup is a var so tests can substitute a mocked CNI result
+// without actually invoking CNI plugins.
+var cniNetworkSetup = runCNINetworkSetup
+
+// selectCNIResult picks the host-side device name (the interface CNI left
+// outside any network namespace, e.g. the host end of a veth/tap pair) and
+// the MAC CNI assigned to the guest-side interface named guestIfName (the
+// one CNI moved into the container's netns).
+func selectCNIResult(ifaces []*current.Interface, guestIfName string) (hostDevName, mac string) {
+	for _, iface := range ifaces {
+		if iface.Sandbox == "" {
+			hostDevName = iface.Name
+			continue
+		}
+		if iface.Name == guestIfName {
+			mac = iface.Mac
+		}
+	}
+	return hostDevName, mac
+}
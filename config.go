@@ -0,0 +1,100 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// envPrefix is the prefix firectl looks for when resolving configuration
+// from the environment, e.g. FIRECTL_ROOT_DRIVE_PATH.
+const envPrefix = "firectl"
+
+// configKeys lists every options field viper resolves from a config file or
+// the environment, by its mapstructure tag (dotted for the nested Jailer
+// fields). AutomaticEnv alone only matches keys viper already knows about
+// from a default or an explicit bind, so every field needs to be bound here
+// for its FIRECTL_* environment variable to actually reach Unmarshal.
+var configKeys = []string{
+	"firecracker_binary",
+	"kernel_image",
+	"kernel_cmd_line",
+	"root_drive_path",
+	"root_partition_uuid",
+	"additional_drives",
+	"nic_config",
+	"cni_networks",
+	"vsock_devices",
+	"log_fifo",
+	"metrics_fifo",
+	"fifo_log_file",
+	"metrics_listen",
+	"socket_path",
+	"cpu_count",
+	"cpu_template",
+	"memory_mib",
+	"disable_hyperthreading",
+	"debug",
+	"vm_id",
+	"jailer.bin_path",
+	"jailer.uid",
+	"jailer.gid",
+	"jailer.chroot_base_dir",
+	"jailer.netns",
+	"jailer.seccomp_filter",
+	"jailer.seccomp_level",
+}
+
+// setConfigDefaults seeds v with the same built-in defaults newOptions
+// would otherwise apply via its flag.FlagSet, so a config file (or the
+// environment) only needs to specify what it wants to override.
+func setConfigDefaults(v *viper.Viper) {
+	v.SetDefault("cpu_count", int64(1))
+	v.SetDefault("memory_mib", int64(512))
+}
+
+// resolveConfig builds the options defaults < file < env layer of
+// firectl's configuration precedence. configPath may be empty, in which
+// case only built-in defaults and the environment are consulted. The
+// caller (newOptions) is responsible for layering CLI flags on top of the
+// result.
+func resolveConfig(configPath string) (*options, error) {
+	v := viper.New()
+	setConfigDefaults(v)
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	for _, key := range configKeys {
+		if err := v.BindEnv(key); err != nil {
+			return nil, fmt.Errorf("binding environment for %s: %v", key, err)
+		}
+	}
+
+	if configPath != "" {
+		v.SetConfigFile(configPath)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("reading config file %s: %v", configPath, err)
+		}
+	}
+
+	opt := &options{}
+	if err := v.Unmarshal(opt); err != nil {
+		return nil, fmt.Errorf("decoding configuration: %v", err)
+	}
+
+	return opt, nil
+}
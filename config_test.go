@@ -0,0 +1,213 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// writeConfigFixture writes contents to a temp file with the given
+// extension so viper can detect its format, returning the path.
+func writeConfigFixture(t *testing.T, ext, contents string) string {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "firectl-config-*."+ext)
+	if err != nil {
+		t.Fatalf("creating config fixture: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("writing config fixture: %v", err)
+	}
+
+	return f.Name()
+}
+
+func TestResolveConfigRoundTrip(t *testing.T) {
+	rootDrive, err := ioutil.TempFile("", "firectl-test-root-drive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(rootDrive.Name())
+	defer rootDrive.Close()
+
+	additionalDrive, err := ioutil.TempFile("", "firectl-test-additional-drive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(additionalDrive.Name())
+	defer additionalDrive.Close()
+
+	cases := []struct {
+		name string
+		ext  string
+		body string
+	}{
+		{
+			name: "yaml",
+			ext:  "yaml",
+			body: fmt.Sprintf(`
+root_drive_path: %s
+root_partition_uuid: UUID
+additional_drives:
+  - %s:ro
+nic_config: valid/things
+log_fifo: testing
+`, rootDrive.Name(), additionalDrive.Name()),
+		},
+		{
+			name: "json",
+			ext:  "json",
+			body: fmt.Sprintf(`{
+	"root_drive_path": %q,
+	"root_partition_uuid": "UUID",
+	"additional_drives": [%q],
+	"nic_config": "valid/things",
+	"log_fifo": "testing"
+}`, rootDrive.Name(), additionalDrive.Name()+":ro"),
+		},
+		{
+			name: "toml",
+			ext:  "toml",
+			body: fmt.Sprintf(`
+root_drive_path = %q
+root_partition_uuid = "UUID"
+additional_drives = [%q]
+nic_config = "valid/things"
+log_fifo = "testing"
+`, rootDrive.Name(), additionalDrive.Name()+":ro"),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := writeConfigFixture(t, c.ext, c.body)
+			defer os.Remove(path)
+
+			opt, err := resolveConfig(path)
+			if err != nil {
+				t.Fatalf("resolveConfig(%s): %v", c.name, err)
+			}
+
+			drives, err := opt.getBlockDevices()
+			if err != nil {
+				t.Fatalf("getBlockDevices: %v", err)
+			}
+			expectedDrives := []models.Drive{
+				{
+					DriveID:      firecracker.String("2"),
+					PathOnHost:   firecracker.String(additionalDrive.Name()),
+					IsRootDevice: firecracker.Bool(false),
+					IsReadOnly:   firecracker.Bool(true),
+				},
+				{
+					DriveID:      firecracker.String("1"),
+					PathOnHost:   firecracker.String(rootDrive.Name()),
+					IsRootDevice: firecracker.Bool(true),
+					IsReadOnly:   firecracker.Bool(false),
+					Partuuid:     "UUID",
+				},
+			}
+			if !reflect.DeepEqual(drives, expectedDrives) {
+				t.Errorf("expected %v but got %v", expectedDrives, drives)
+			}
+
+			nics, err := opt.getNetwork()
+			if err != nil {
+				t.Fatalf("getNetwork: %v", err)
+			}
+			expectedNics := []firecracker.NetworkInterface{
+				{
+					MacAddress:  "things",
+					HostDevName: "valid",
+				},
+			}
+			if !reflect.DeepEqual(nics, expectedNics) {
+				t.Errorf("expected %v but got %v", expectedNics, nics)
+			}
+
+			w, err := opt.handleFifos()
+			if err != nil {
+				t.Fatalf("handleFifos: %v", err)
+			}
+			defer opt.Close()
+			if w != nil {
+				t.Errorf("expected a nil writer since fifo-log-file wasn't set")
+			}
+			if opt.FcLogFifo != "testing" {
+				t.Errorf("expected the file's log_fifo to survive unmarshalling, got %q", opt.FcLogFifo)
+			}
+			if opt.FcMetricsFifo == "" {
+				t.Errorf("expected an auto-generated metrics fifo")
+			}
+		})
+	}
+}
+
+// TestResolveConfigEnvOverride proves the env layer actually overrides the
+// file (and defaults) layer below it, for both a top-level field and a
+// nested Jailer field.
+func TestResolveConfigEnvOverride(t *testing.T) {
+	path := writeConfigFixture(t, "yaml", "root_drive_path: /from-file\n")
+	defer os.Remove(path)
+
+	os.Setenv("FIRECTL_ROOT_DRIVE_PATH", "/from-env")
+	defer os.Unsetenv("FIRECTL_ROOT_DRIVE_PATH")
+	os.Setenv("FIRECTL_JAILER_CHROOT_BASE_DIR", "/srv/jailer")
+	defer os.Unsetenv("FIRECTL_JAILER_CHROOT_BASE_DIR")
+	os.Setenv("FIRECTL_CPU_COUNT", "4")
+	defer os.Unsetenv("FIRECTL_CPU_COUNT")
+
+	opt, err := resolveConfig(path)
+	if err != nil {
+		t.Fatalf("resolveConfig: %v", err)
+	}
+
+	if opt.FcRootDrivePath != "/from-env" {
+		t.Errorf("expected env to override the config file's root_drive_path, got %q", opt.FcRootDrivePath)
+	}
+	if opt.Jailer.ChrootBaseDir != "/srv/jailer" {
+		t.Errorf("expected env to set jailer.chroot_base_dir, got %q", opt.Jailer.ChrootBaseDir)
+	}
+	if opt.FcCPUCount != 4 {
+		t.Errorf("expected env to override the cpu_count default, got %d", opt.FcCPUCount)
+	}
+}
+
+func TestResolveConfigDefaults(t *testing.T) {
+	opt, err := resolveConfig("")
+	if err != nil {
+		t.Fatalf("resolveConfig(\"\"): %v", err)
+	}
+	if opt.FcCPUCount != 1 {
+		t.Errorf("expected default cpu_count of 1, got %d", opt.FcCPUCount)
+	}
+	if opt.FcMemSz != 512 {
+		t.Errorf("expected default memory_mib of 512, got %d", opt.FcMemSz)
+	}
+}
+
+func TestResolveConfigMissingFile(t *testing.T) {
+	if _, err := resolveConfig("/does/not/exist.yaml"); err == nil {
+		t.Errorf("expected an error resolving a nonexistent config file")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// jailerConfig holds the --jailer-* / --seccomp-* flags. An empty BinPath
+// means the jailer is unused and firecracker runs unconfined, directly on
+// the host.
+type jailerConfig struct {
+	BinPath       string `mapstructure:"bin_path"`
+	UID           int    `mapstructure:"uid"`
+	GID           int    `mapstructure:"gid"`
+	ChrootBaseDir string `mapstructure:"chroot_base_dir"`
+	NetNS         string `mapstructure:"netns"`
+	SeccompFilter string `mapstructure:"seccomp_filter"`
+	SeccompLevel  int    `mapstructure:"seccomp_level"`
+}
+
+// getJailer builds the firecracker.JailerConfig WithJailerConfig expects
+// from opt.Jailer. It returns (nil, nil) when --jailer-bin wasn't set,
+// meaning firectl should run firecracker unjailed.
+func (opt *options) getJailer() (*firecracker.JailerConfig, error) {
+	if opt.Jailer.BinPath == "" {
+		return nil, nil
+	}
+
+	cfg := &firecracker.JailerConfig{
+		JailerBinary:   opt.Jailer.BinPath,
+		ID:             opt.cniContainerID(),
+		UID:            firecracker.Int(opt.Jailer.UID),
+		GID:            firecracker.Int(opt.Jailer.GID),
+		ChrootBaseDir:  opt.Jailer.ChrootBaseDir,
+		NetNS:          opt.Jailer.NetNS,
+		ExecFile:       opt.FcBinary,
+		ChrootStrategy: firecracker.NewNaiveChrootStrategy(opt.FcKernelImage),
+		Stdout:         os.Stdout,
+		Stderr:         os.Stderr,
+	}
+
+	if opt.Jailer.SeccompFilter != "" {
+		f, err := os.Open(opt.Jailer.SeccompFilter)
+		if err != nil {
+			return nil, fmt.Errorf("opening seccomp filter %s: %v", opt.Jailer.SeccompFilter, err)
+		}
+		cfg.Seccomp = firecracker.SeccompConfig{Enabled: firecracker.Bool(true), Filter: f}
+	} else if opt.Jailer.SeccompLevel != 0 {
+		cfg.Seccomp = firecracker.SeccompConfig{Enabled: firecracker.Bool(true), Level: opt.Jailer.SeccompLevel}
+	}
+
+	return cfg, nil
+}
+
+// jailerChrootDir is the directory the jailer chroots firecracker into for
+// this VM, following its own "<chroot-base>/<exec-file-basename>/<id>/root"
+// convention.
+func (opt *options) jailerChrootDir() string {
+	return filepath.Join(opt.Jailer.ChrootBaseDir, filepath.Base(opt.FcBinary), opt.cniContainerID(), "root")
+}
+
+// hardlinkCloser removes its path on Close, undoing the hardlink
+// jailSandbox created inside the chroot.
+type hardlinkCloser string
+
+func (p hardlinkCloser) Close() error {
+	return os.Remove(string(p))
+}
+
+// jailSandbox makes hostPath visible inside this VM's jailer chroot (if
+// --jailer-bin was set) by hardlinking it to name under the chroot root,
+// and returns the path firecracker should be told to use instead:
+// unchanged when no jailer is configured, chroot-relative (as firecracker
+// itself will see it once chrooted) otherwise. name must be unique per
+// caller (e.g. a drive id) — two files sharing a basename would otherwise
+// collide inside the chroot even though their host paths differ. The
+// hardlink is torn down via opt.closers on shutdown.
+func (opt *options) jailSandbox(hostPath, name string) (string, error) {
+	if opt.Jailer.BinPath == "" {
+		return hostPath, nil
+	}
+
+	inChroot := filepath.Join("/", name)
+	onHost := filepath.Join(opt.jailerChrootDir(), inChroot)
+
+	if existing, err := os.Stat(onHost); err == nil {
+		target, err := os.Stat(hostPath)
+		if err == nil && os.SameFile(existing, target) {
+			return inChroot, nil
+		}
+	}
+
+	if err := os.Link(hostPath, onHost); err != nil {
+		return "", fmt.Errorf("hardlinking %s into jailer chroot: %v", hostPath, err)
+	}
+	opt.closers = append(opt.closers, hardlinkCloser(onHost))
+
+	return inChroot, nil
+}
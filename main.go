@@ -0,0 +1,178 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	opt, err := newOptions(os.Args[1:])
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	defer opt.Close()
+
+	if err := runVMM(context.Background(), opt); err != nil {
+		log.Fatalf("firectl failed to run: %v", err)
+	}
+}
+
+// newOptions resolves firectl's configuration with the usual precedence:
+// built-in defaults, then an optional --config file, then the environment,
+// then CLI flags. The config file is located by scanning args directly
+// (configFlagArg) rather than a pre-parse flag.FlagSet, since flag.Parse
+// stops at the first flag it doesn't recognize and would miss --config
+// whenever an earlier flag hadn't been registered yet. The "real"
+// flag.FlagSet below then uses the resolved config as flag defaults,
+// making flags the final, highest-precedence layer.
+func newOptions(args []string) (*options, error) {
+	configPath := configFlagArg(args)
+
+	opt, err := resolveConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := flag.NewFlagSet("firectl", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", configPath, "path to a YAML/JSON/TOML config file")
+	fs.StringVar(&opt.FcBinary, "firecracker-binary", opt.FcBinary, "path to firecracker binary")
+	fs.StringVar(&opt.FcKernelImage, "kernel", opt.FcKernelImage, "path to the kernel image")
+	fs.StringVar(&opt.FcKernelCmdLine, "kernel-opts", opt.FcKernelCmdLine, "kernel boot args")
+	fs.StringVar(&opt.FcRootDrivePath, "root-drive", opt.FcRootDrivePath, "path to the root drive image")
+	fs.StringVar(&opt.FcRootPartUUID, "root-partition", opt.FcRootPartUUID, "root partition UUID")
+	fs.Var(newStringSliceFlag(&opt.FcAdditionalDrives), "drive", "additional drive, repeatable: key=value,... or the legacy PATH:SUFFIX")
+	fs.Var(newStringSliceFlag(&opt.FcNicConfig), "nic", "NIC configuration, repeatable: key=value,... or the legacy DEVICE/MAC")
+	fs.Var(newStringSliceFlag(&opt.FcCNINetworks), "cni-network", "CNI-managed NIC, repeatable: network=NAME[,ifname=...,binpath=...,confdir=...]")
+	fs.StringVar(&opt.FcVMID, "vm-id", opt.FcVMID, "VM identifier, also used as the CNI container ID")
+	fs.Var(newStringSliceFlag(&opt.FcVsockDevices), "vsock-device", "vsock device, repeatable: path=PATH,cid=CID[,forward=PROTO:HOSTADDR->guest:PORT]...")
+	fs.StringVar(&opt.FcLogFifo, "vmm-log-fifo", opt.FcLogFifo, "path to the VMM log FIFO")
+	fs.StringVar(&opt.FcMetricsFifo, "metrics-fifo", opt.FcMetricsFifo, "path to the VMM metrics FIFO")
+	fs.StringVar(&opt.FcMetricsListen, "metrics-listen", opt.FcMetricsListen, "serve Prometheus metrics (and /healthz) on this address, e.g. :9091")
+	fs.StringVar(&opt.FcFifoLogFile, "fifo-log-file", opt.FcFifoLogFile, "write the VMM log FIFO's contents to this file")
+	fs.StringVar(&opt.FcSocketPath, "socket-path", opt.FcSocketPath, "path to the firecracker API socket")
+	fs.Int64Var(&opt.FcCPUCount, "ncpus", opt.FcCPUCount, "number of vCPUs")
+	fs.StringVar(&opt.FcCPUTemplate, "cpu-template", opt.FcCPUTemplate, "firecracker CPU template")
+	fs.Int64Var(&opt.FcMemSz, "memory", opt.FcMemSz, "VM memory, in MiB")
+	fs.BoolVar(&opt.FcDisableHt, "disable-hyperthreading", opt.FcDisableHt, "disable guest hyperthreading")
+	fs.BoolVar(&opt.FcDebug, "debug", opt.FcDebug, "enable debug logging")
+	fs.StringVar(&opt.Jailer.BinPath, "jailer-bin", opt.Jailer.BinPath, "path to the jailer binary; enables jailer sandboxing")
+	fs.IntVar(&opt.Jailer.UID, "jailer-uid", opt.Jailer.UID, "UID the jailed firecracker process runs as")
+	fs.IntVar(&opt.Jailer.GID, "jailer-gid", opt.Jailer.GID, "GID the jailed firecracker process runs as")
+	fs.StringVar(&opt.Jailer.ChrootBaseDir, "jailer-chroot", opt.Jailer.ChrootBaseDir, "base directory the jailer builds its chroot jail under")
+	fs.StringVar(&opt.Jailer.NetNS, "jailer-netns", opt.Jailer.NetNS, "path to the network namespace the jailer should join")
+	fs.StringVar(&opt.Jailer.SeccompFilter, "seccomp-filter", opt.Jailer.SeccompFilter, "path to a custom seccomp filter file")
+	fs.IntVar(&opt.Jailer.SeccompLevel, "seccomp-level", opt.Jailer.SeccompLevel, "seccomp filtering level (0=off, 1=basic, 2=advanced)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// configFlagArg scans args for -config/--config, in either the "-config
+// value" or "-config=value" form, regardless of where it falls among the
+// other flags. It can't use a flag.FlagSet pre-parse for this: flag.Parse
+// stops at the first flag it doesn't recognize, so a throwaway FlagSet
+// that only knows -config would silently miss it whenever some other flag
+// came first on the command line.
+func configFlagArg(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "-config" || arg == "--config":
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+			return ""
+		case strings.HasPrefix(arg, "-config="):
+			return strings.TrimPrefix(arg, "-config=")
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return ""
+}
+
+// stringSliceFlag implements flag.Value for repeatable string flags that
+// are layered over a config-file/default value already in values: the
+// first Set call (i.e. the first occurrence of the flag on the command
+// line) discards whatever values already held, so that passing the flag
+// overrides the file instead of appending to it, matching firectl's
+// file < flags precedence.
+type stringSliceFlag struct {
+	values *[]string
+	isSet  bool
+}
+
+func newStringSliceFlag(values *[]string) *stringSliceFlag {
+	return &stringSliceFlag{values: values}
+}
+
+func (s *stringSliceFlag) String() string {
+	if s.values == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", *s.values)
+}
+
+func (s *stringSliceFlag) Set(v string) error {
+	if !s.isSet {
+		*s.values = nil
+		s.isSet = true
+	}
+	*s.values = append(*s.values, v)
+	return nil
+}
+
+// runVMM resolves opt's drives, NICs, vsock devices, FIFOs and jailer
+// config and logs a summary of them. It does not build a firecracker.Config
+// or start the VM.
+func runVMM(ctx context.Context, opt *options) error {
+	drives, err := opt.getBlockDevices()
+	if err != nil {
+		return fmt.Errorf("building block devices: %v", err)
+	}
+
+	nics, err := opt.getNetwork()
+	if err != nil {
+		return fmt.Errorf("building network interfaces: %v", err)
+	}
+
+	vsocks, err := opt.getVsocks()
+	if err != nil {
+		return fmt.Errorf("building vsock devices: %v", err)
+	}
+
+	_, err = opt.handleFifos()
+	if err != nil {
+		return fmt.Errorf("setting up fifos: %v", err)
+	}
+
+	jailerCfg, err := opt.getJailer()
+	if err != nil {
+		return fmt.Errorf("building jailer config: %v", err)
+	}
+
+	log.Debugf("launching with %d drives, %d nics, %d vsocks, jailed=%t",
+		len(drives), len(nics), len(vsocks), jailerCfg != nil)
+
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import "testing"
+
+func TestConfigFlagArg(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "config first",
+			args: []string{"-config", "vm.yaml", "-debug"},
+			want: "vm.yaml",
+		},
+		{
+			name: "config after other flags",
+			args: []string{"-debug", "-ncpus", "2", "-config", "vm.yaml"},
+			want: "vm.yaml",
+		},
+		{
+			name: "double-dash equals form",
+			args: []string{"--debug", "--config=vm.yaml"},
+			want: "vm.yaml",
+		},
+		{
+			name: "single-dash equals form",
+			args: []string{"-config=vm.yaml"},
+			want: "vm.yaml",
+		},
+		{
+			name: "not present",
+			args: []string{"-debug", "-ncpus", "2"},
+			want: "",
+		},
+		{
+			name: "trailing flag with no value",
+			args: []string{"-debug", "-config"},
+			want: "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := configFlagArg(c.args); got != c.want {
+				t.Errorf("configFlagArg(%v) = %q, want %q", c.args, got, c.want)
+			}
+		})
+	}
+}
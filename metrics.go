@@ -0,0 +1,167 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// firecrackerMetric counts every numeric field Firecracker reports on the
+// metrics FIFO, labeled by its (possibly nested, dot-joined) field name.
+var firecrackerMetric = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "firecracker",
+		Name:      "metric",
+		Help:      "Numeric fields reported on the Firecracker metrics FIFO.",
+	},
+	[]string{"metric"},
+)
+
+func init() {
+	prometheus.MustRegister(firecrackerMetric)
+}
+
+// metricsReader tails a Firecracker metrics FIFO, recording every numeric
+// field it reports via firecrackerMetric until Close is called.
+type metricsReader struct {
+	fifo *os.File
+	done chan struct{}
+}
+
+func (m *metricsReader) Close() error {
+	close(m.done)
+	return m.fifo.Close()
+}
+
+func (m *metricsReader) run() {
+	scanner := bufio.NewScanner(nonblockingReader{f: m.fifo, done: m.done})
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Warnf("discarding unparsable metrics record: %v", err)
+			continue
+		}
+
+		recordMetrics("", record)
+	}
+}
+
+// recordMetrics walks record, adding each numeric leaf's value to the
+// Prometheus counter for its dotted field name. Nested objects (as
+// Firecracker uses to group its metrics, e.g. "block", "net") contribute
+// their own dotted prefix.
+func recordMetrics(prefix string, record map[string]interface{}) {
+	for k, v := range record {
+		name := k
+		if prefix != "" {
+			name = prefix + "." + k
+		}
+
+		switch val := v.(type) {
+		case float64:
+			firecrackerMetric.WithLabelValues(name).Add(val)
+		case map[string]interface{}:
+			recordMetrics(name, val)
+		}
+	}
+}
+
+// nonblockingReader adapts a FIFO opened with O_NONBLOCK to the blocking
+// io.Reader interface bufio.Scanner expects. Opening a FIFO for reading
+// blocks until a writer opens the other end, which would deadlock
+// handleFifos (called before Firecracker, the FIFO's only writer, is
+// launched), so startMetricsReader opens non-blocking instead. A read of
+// such a FIFO returns EOF while no writer has it open (and EAGAIN while a
+// writer has it open with nothing written), so this polls through both
+// until data arrives or done is closed.
+type nonblockingReader struct {
+	f    *os.File
+	done <-chan struct{}
+}
+
+func (r nonblockingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || (err != io.EOF && !errors.Is(err, syscall.EAGAIN)) {
+			return n, err
+		}
+
+		select {
+		case <-r.done:
+			return 0, io.EOF
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// startMetricsReader opens fifoPath for reading, non-blocking so the open
+// itself can't deadlock waiting on Firecracker to start writing, and spawns
+// a goroutine recording every sample written to it. The returned io.Closer
+// stops the goroutine and closes the FIFO.
+func startMetricsReader(fifoPath string) (io.Closer, error) {
+	f, err := os.OpenFile(fifoPath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening metrics fifo %s: %v", fifoPath, err)
+	}
+
+	reader := &metricsReader{fifo: f, done: make(chan struct{})}
+	go reader.run()
+
+	return reader, nil
+}
+
+// metricsServer is the optional HTTP endpoint --metrics-listen exposes,
+// serving /metrics (Prometheus) and /healthz.
+type metricsServer struct {
+	ln  net.Listener
+	srv *http.Server
+}
+
+func (m *metricsServer) Close() error {
+	return m.srv.Close()
+}
+
+// startMetricsServer binds addr and serves /metrics and /healthz until the
+// returned io.Closer is closed.
+func startMetricsServer(addr string) (io.Closer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+
+	return &metricsServer{ln: ln, srv: srv}, nil
+}
@@ -0,0 +1,592 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	fifoLogFilePattern     = "*fc_fifo"
+	fifoMetricsFilePattern = "*fc_metrics_fifo"
+)
+
+var (
+	invalidDriveSpecificationNoSuffix = errors.New("drive specification missing ':suffix'")
+	invalidDriveSpecificationNoPath   = errors.New("drive specification missing path before ':suffix'")
+	parseNicConfigError               = errors.New("invalid NIC configuration, should be: DEVICE/MAC or key=value,...")
+	conflictingLogOptsSet             = errors.New("vmm-log-fifo and fifo-log-file cannot be used together")
+
+	malformedKeyValue = errors.New("malformed key=value pair")
+	unknownDriveKey   = errors.New("unknown --drive key")
+	duplicateDriveID  = errors.New("duplicate drive id")
+	unknownNicKey     = errors.New("unknown --nic key")
+)
+
+// options holds the resolved configuration firectl uses to build a
+// firecracker.Config and launch the VMM. Its fields are populated from
+// built-in defaults, an optional config file and the environment (see
+// config.go), then CLI flags (see main.go).
+type options struct {
+	FcBinary        string `mapstructure:"firecracker_binary"`
+	FcKernelImage   string `mapstructure:"kernel_image"`
+	FcKernelCmdLine string `mapstructure:"kernel_cmd_line"`
+
+	FcRootDrivePath    string   `mapstructure:"root_drive_path"`
+	FcRootPartUUID     string   `mapstructure:"root_partition_uuid"`
+	FcAdditionalDrives []string `mapstructure:"additional_drives"`
+
+	// FcNicConfig carries one --nic specification per repetition; each
+	// entry yields one firecracker.NetworkInterface.
+	FcNicConfig []string `mapstructure:"nic_config"`
+	// FcCNINetworks carries one --cni-network specification per
+	// repetition, each delegating its tap/bridge setup to CNI plugins and
+	// contributing an additional NetworkInterface.
+	FcCNINetworks []string `mapstructure:"cni_networks"`
+
+	FcVsockDevices []string `mapstructure:"vsock_devices"`
+
+	FcLogFifo     string `mapstructure:"log_fifo"`
+	FcMetricsFifo string `mapstructure:"metrics_fifo"`
+	FcFifoLogFile string `mapstructure:"fifo_log_file"`
+	// FcMetricsListen, if set, serves a Prometheus /metrics endpoint (and
+	// /healthz) built from the samples Firecracker writes to
+	// FcMetricsFifo, e.g. ":9091".
+	FcMetricsListen string `mapstructure:"metrics_listen"`
+
+	FcSocketPath  string `mapstructure:"socket_path"`
+	FcCPUCount    int64  `mapstructure:"cpu_count"`
+	FcCPUTemplate string `mapstructure:"cpu_template"`
+	FcMemSz       int64  `mapstructure:"memory_mib"`
+	FcDisableHt   bool   `mapstructure:"disable_hyperthreading"`
+	FcDebug       bool   `mapstructure:"debug"`
+	// FcVMID identifies this VM to firecracker and to any CNI networks it
+	// attaches to. Defaults to a pid-derived value when unset.
+	FcVMID string `mapstructure:"vm_id"`
+
+	// Jailer configures firecracker's jailer/seccomp sandboxing. A zero
+	// value (Jailer.BinPath == "") means firecracker runs unjailed.
+	Jailer jailerConfig `mapstructure:"jailer"`
+
+	// validMetadata holds the decoded MMDS seed metadata, if any was
+	// supplied. A non-zero value means the NIC(s) built from this options
+	// should advertise MMDS to the guest.
+	validMetadata int
+
+	// closers collects cleanup actions (temp FIFOs, chroot hardlinks, proxies, ...)
+	// that must run when the VMM shuts down.
+	closers []io.Closer
+}
+
+// Close runs every registered closer, in the order they were registered.
+func (opt *options) Close() {
+	for _, c := range opt.closers {
+		c.Close()
+	}
+}
+
+// removeCloser is an io.Closer that removes the named file on Close. It's
+// used to clean up the temporary FIFOs firectl creates on the host's behalf.
+type removeCloser string
+
+func (p removeCloser) Close() error {
+	return os.Remove(string(p))
+}
+
+// splitKV splits a Docker-style comma-separated key=value specification
+// ("id=root,path=/img.ext4,readonly=true") into a field map.
+func splitKV(entry string) (map[string]string, error) {
+	fields := map[string]string{}
+	for _, kv := range strings.Split(entry, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, malformedKeyValue
+		}
+		fields[parts[0]] = parts[1]
+	}
+	return fields, nil
+}
+
+// applyRateLimiterField decodes one "ratelimiter-{bw,ops}-{size,refill-ms}"
+// field into the matching models.TokenBucket on rl, creating it on first
+// use.
+func applyRateLimiterField(rl *models.RateLimiter, key, value string) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return malformedKeyValue
+	}
+
+	bucket := func(b **models.TokenBucket) *models.TokenBucket {
+		if *b == nil {
+			*b = &models.TokenBucket{}
+		}
+		return *b
+	}
+
+	switch key {
+	case "ratelimiter-bw-size":
+		bucket(&rl.Bandwidth).Size = firecracker.Int64(n)
+	case "ratelimiter-bw-refill-ms":
+		bucket(&rl.Bandwidth).RefillTime = firecracker.Int64(n)
+	case "ratelimiter-ops-size":
+		bucket(&rl.Ops).Size = firecracker.Int64(n)
+	case "ratelimiter-ops-refill-ms":
+		bucket(&rl.Ops).RefillTime = firecracker.Int64(n)
+	}
+	return nil
+}
+
+// parseDriveDSL decodes a "key=value,..." --drive specification. id and
+// root default to the positional index + 2/false when not given, matching the
+// legacy syntax's behavior.
+func parseDriveDSL(entry string, index int) (models.Drive, error) {
+	fields, err := splitKV(entry)
+	if err != nil {
+		return models.Drive{}, err
+	}
+
+	id := strconv.Itoa(index + 2)
+	path := ""
+	readOnly := false
+	isRoot := false
+	partuuid := ""
+	var rateLimiter *models.RateLimiter
+
+	for k, v := range fields {
+		switch k {
+		case "id":
+			id = v
+		case "path":
+			path = v
+		case "partuuid":
+			partuuid = v
+		case "readonly":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return models.Drive{}, malformedKeyValue
+			}
+			readOnly = b
+		case "root":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return models.Drive{}, malformedKeyValue
+			}
+			isRoot = b
+		case "ratelimiter-bw-size", "ratelimiter-bw-refill-ms", "ratelimiter-ops-size", "ratelimiter-ops-refill-ms":
+			if rateLimiter == nil {
+				rateLimiter = &models.RateLimiter{}
+			}
+			if err := applyRateLimiterField(rateLimiter, k, v); err != nil {
+				return models.Drive{}, err
+			}
+		default:
+			return models.Drive{}, unknownDriveKey
+		}
+	}
+
+	if path == "" {
+		return models.Drive{}, invalidDriveSpecificationNoPath
+	}
+	if _, err := os.Stat(path); err != nil {
+		return models.Drive{}, err
+	}
+
+	return models.Drive{
+		DriveID:      firecracker.String(id),
+		PathOnHost:   firecracker.String(path),
+		IsReadOnly:   firecracker.Bool(readOnly),
+		IsRootDevice: firecracker.Bool(isRoot),
+		Partuuid:     partuuid,
+		RateLimiter:  rateLimiter,
+	}, nil
+}
+
+// parseLegacyDrive decodes the original "path:suffix" --drive syntax.
+func parseLegacyDrive(entry string, index int) (models.Drive, error) {
+	splitPath := strings.SplitAfterN(entry, ":", 2)
+	if len(splitPath) != 2 {
+		return models.Drive{}, invalidDriveSpecificationNoSuffix
+	}
+
+	path := strings.TrimSuffix(splitPath[0], ":")
+	if path == "" {
+		return models.Drive{}, invalidDriveSpecificationNoPath
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return models.Drive{}, err
+	}
+
+	suffix := splitPath[1]
+	return models.Drive{
+		DriveID:      firecracker.String(strconv.Itoa(index + 2)),
+		PathOnHost:   firecracker.String(path),
+		IsRootDevice: firecracker.Bool(false),
+		IsReadOnly:   firecracker.Bool(suffix == "ro"),
+	}, nil
+}
+
+// parseBlockDevices turns a list of --drive specifications into
+// models.Drive entries. Each entry is either the key=value DSL
+// ("path=/img.ext4,readonly=true,...") or, for backwards compatibility,
+// the legacy "path:suffix" form, which logs a deprecation warning. Drive
+// IDs default to the positional index + 2, since getBlockDevices reserves
+// "1" for the root drive.
+func parseBlockDevices(entries []string) ([]models.Drive, error) {
+	var devices []models.Drive
+	seenIDs := map[string]bool{}
+
+	for i, entry := range entries {
+		var d models.Drive
+		var err error
+		if strings.Contains(entry, "=") {
+			d, err = parseDriveDSL(entry, i)
+		} else {
+			log.Warnf("--drive %q uses the deprecated PATH:SUFFIX syntax, use key=value instead", entry)
+			d, err = parseLegacyDrive(entry, i)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if seenIDs[*d.DriveID] {
+			return nil, duplicateDriveID
+		}
+		seenIDs[*d.DriveID] = true
+
+		devices = append(devices, d)
+	}
+
+	return devices, nil
+}
+
+// getBlockDevices resolves opt.FcAdditionalDrives and, unless one of them
+// already declared itself the root device via root=true, appends the
+// root drive built from FcRootDrivePath/FcRootPartUUID. When a jailer is
+// configured (see jailer.go), every drive's backing file is hardlinked
+// into the jailer chroot and PathOnHost is rewritten to the path
+// firecracker will see once chrooted.
+func (opt *options) getBlockDevices() ([]models.Drive, error) {
+	devices, err := parseBlockDevices(opt.FcAdditionalDrives)
+	if err != nil {
+		return nil, err
+	}
+
+	haveRoot := false
+	for _, d := range devices {
+		if d.IsRootDevice != nil && *d.IsRootDevice {
+			haveRoot = true
+		}
+	}
+
+	if !haveRoot {
+		devices = append(devices, models.Drive{
+			DriveID:      firecracker.String("1"),
+			PathOnHost:   firecracker.String(opt.FcRootDrivePath),
+			IsRootDevice: firecracker.Bool(true),
+			IsReadOnly:   firecracker.Bool(false),
+			Partuuid:     opt.FcRootPartUUID,
+		})
+	}
+
+	for i, d := range devices {
+		jailedPath, err := opt.jailSandbox(*d.PathOnHost, "drive-"+*d.DriveID)
+		if err != nil {
+			return nil, err
+		}
+		devices[i].PathOnHost = firecracker.String(jailedPath)
+	}
+
+	return devices, nil
+}
+
+// nicSpec is the decoded form of a --nic specification.
+type nicSpec struct {
+	Device        string
+	Mac           string
+	Mtu           int
+	AllowMDDS     bool
+	RxRateLimiter *models.RateLimiter
+	TxRateLimiter *models.RateLimiter
+}
+
+// applyNicRateLimiterField decodes one "{rx,tx}-rate{,-refill-ms}" field
+// into the matching rate limiter on spec, creating it on first use.
+func applyNicRateLimiterField(spec *nicSpec, key, value string) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return malformedKeyValue
+	}
+
+	bucket := func(rl **models.RateLimiter) *models.TokenBucket {
+		if *rl == nil {
+			*rl = &models.RateLimiter{}
+		}
+		if (*rl).Bandwidth == nil {
+			(*rl).Bandwidth = &models.TokenBucket{}
+		}
+		return (*rl).Bandwidth
+	}
+
+	switch key {
+	case "rx-rate":
+		bucket(&spec.RxRateLimiter).Size = firecracker.Int64(n)
+	case "rx-rate-refill-ms":
+		bucket(&spec.RxRateLimiter).RefillTime = firecracker.Int64(n)
+	case "tx-rate":
+		bucket(&spec.TxRateLimiter).Size = firecracker.Int64(n)
+	case "tx-rate-refill-ms":
+		bucket(&spec.TxRateLimiter).RefillTime = firecracker.Int64(n)
+	}
+	return nil
+}
+
+// parseNicDSL decodes a "key=value,..." --nic specification.
+func parseNicDSL(cfg string) (nicSpec, error) {
+	fields, err := splitKV(cfg)
+	if err != nil {
+		return nicSpec{}, err
+	}
+
+	var spec nicSpec
+	for k, v := range fields {
+		switch k {
+		case "device":
+			spec.Device = v
+		case "mac":
+			spec.Mac = v
+		case "mtu":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nicSpec{}, malformedKeyValue
+			}
+			spec.Mtu = n
+		case "allow-mmds":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nicSpec{}, malformedKeyValue
+			}
+			spec.AllowMDDS = b
+		case "rx-rate", "rx-rate-refill-ms", "tx-rate", "tx-rate-refill-ms":
+			if err := applyNicRateLimiterField(&spec, k, v); err != nil {
+				return nicSpec{}, err
+			}
+		default:
+			return nicSpec{}, unknownNicKey
+		}
+	}
+
+	if spec.Device == "" || spec.Mac == "" {
+		return nicSpec{}, parseNicConfigError
+	}
+
+	return spec, nil
+}
+
+// parseNicConfig decodes a --nic specification, either the key=value DSL
+// or, for backwards compatibility, the legacy "device/mac" form, which
+// logs a deprecation warning.
+func parseNicConfig(cfg string) (nicSpec, error) {
+	if strings.Contains(cfg, "=") {
+		return parseNicDSL(cfg)
+	}
+
+	log.Warnf("--nic %q uses the deprecated DEVICE/MAC syntax, use key=value instead", cfg)
+	fields := strings.Split(cfg, "/")
+	if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		return nicSpec{}, parseNicConfigError
+	}
+
+	return nicSpec{Device: fields[0], Mac: fields[1]}, nil
+}
+
+// applyNicMtu sets device's MTU to mtu. Firecracker's NetworkInterface has
+// no MTU setting of its own: the guest's virtio-net device simply inherits
+// whatever MTU the host tap device is configured with, so a --nic mtu=
+// value has to be applied directly to the (already-existing) host tap
+// rather than threaded through the SDK.
+func applyNicMtu(device string, mtu int) error {
+	link, err := netlink.LinkByName(device)
+	if err != nil {
+		return fmt.Errorf("looking up tap device %q for --nic mtu: %v", device, err)
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("setting mtu %d on tap device %q: %v", mtu, device, err)
+	}
+	return nil
+}
+
+// setNicMtu is a var so tests can substitute a no-op for applyNicMtu, which
+// requires manipulating a real host tap device.
+var setNicMtu = applyNicMtu
+
+// cniContainerID identifies this VM to CNI plugins invoked on its behalf.
+func (opt *options) cniContainerID() string {
+	if opt.FcVMID != "" {
+		return opt.FcVMID
+	}
+	return fmt.Sprintf("firectl-%d", os.Getpid())
+}
+
+// getNetwork builds the NetworkInterfaces firecracker should use: one per
+// opt.FcNicConfig entry, followed by one per opt.FcCNINetworks entry, in
+// that order. It returns (nil, nil) when no NIC was requested. A --nic
+// mtu= is applied directly to the host tap device via setNicMtu, since
+// it has nowhere to live on firecracker.NetworkInterface itself.
+func (opt *options) getNetwork() ([]firecracker.NetworkInterface, error) {
+	var nics []firecracker.NetworkInterface
+
+	for _, cfg := range opt.FcNicConfig {
+		spec, err := parseNicConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if spec.Mtu != 0 {
+			if err := setNicMtu(spec.Device, spec.Mtu); err != nil {
+				return nil, err
+			}
+		}
+
+		nics = append(nics, firecracker.NetworkInterface{
+			MacAddress:     spec.Mac,
+			HostDevName:    spec.Device,
+			AllowMDDS:      spec.AllowMDDS || opt.validMetadata != 0,
+			InRateLimiter:  spec.RxRateLimiter,
+			OutRateLimiter: spec.TxRateLimiter,
+		})
+	}
+
+	for _, cfg := range opt.FcCNINetworks {
+		spec, err := parseCNISpec(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		nic, closer, err := cniNetworkSetup(opt.cniContainerID(), spec)
+		if err != nil {
+			return nil, err
+		}
+		opt.closers = append(opt.closers, closer)
+
+		nics = append(nics, nic)
+	}
+
+	return nics, nil
+}
+
+// createFifo reserves a unique path matching pattern (via ioutil.TempFile)
+// and replaces it with a named pipe, so the file Firecracker opens for
+// writing is an actual FIFO rather than a plain file.
+func createFifo(pattern string) (string, error) {
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// handleFifos wires up the VMM log and metrics FIFOs. If FcLogFifo or
+// FcMetricsFifo weren't set explicitly, a FIFO is created at a generated
+// path for each and registered for cleanup via opt.closers. If
+// FcFifoLogFile is set, its contents are written to that file instead of
+// this process's stdout; the caller is responsible for closing the
+// returned writer. If FcMetricsListen is set, a background reader starts
+// tailing the metrics FIFO into Prometheus counters, served over HTTP. When
+// a jailer is configured (see jailer.go), both FIFOs are hardlinked into
+// the jailer chroot and opt.FcLogFifo/opt.FcMetricsFifo are rewritten to
+// the paths firecracker will see once chrooted; the metrics reader keeps
+// tailing the original host-side FIFO, since the hardlink shares its inode.
+func (opt *options) handleFifos() (io.Writer, error) {
+	if opt.FcFifoLogFile != "" && opt.FcLogFifo != "" {
+		return nil, conflictingLogOptsSet
+	}
+
+	var w io.Writer
+	if opt.FcFifoLogFile != "" {
+		f, err := os.OpenFile(opt.FcFifoLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create fifo log file: %v", err)
+		}
+		w = f
+	}
+
+	if opt.FcLogFifo == "" {
+		path, err := createFifo(fifoLogFilePattern)
+		if err != nil {
+			return nil, err
+		}
+		opt.FcLogFifo = path
+		opt.closers = append(opt.closers, removeCloser(path))
+	}
+
+	if opt.FcMetricsFifo == "" {
+		path, err := createFifo(fifoMetricsFilePattern)
+		if err != nil {
+			return nil, err
+		}
+		opt.FcMetricsFifo = path
+		opt.closers = append(opt.closers, removeCloser(path))
+	}
+
+	hostMetricsFifo := opt.FcMetricsFifo
+
+	jailedLogFifo, err := opt.jailSandbox(opt.FcLogFifo, "vmm-log-fifo")
+	if err != nil {
+		return nil, err
+	}
+	opt.FcLogFifo = jailedLogFifo
+
+	jailedMetricsFifo, err := opt.jailSandbox(opt.FcMetricsFifo, "vmm-metrics-fifo")
+	if err != nil {
+		return nil, err
+	}
+	opt.FcMetricsFifo = jailedMetricsFifo
+
+	if opt.FcMetricsListen != "" {
+		reader, err := startMetricsReader(hostMetricsFifo)
+		if err != nil {
+			return nil, err
+		}
+		opt.closers = append(opt.closers, reader)
+
+		server, err := startMetricsServer(opt.FcMetricsListen)
+		if err != nil {
+			return nil, err
+		}
+		opt.closers = append(opt.closers, server)
+	}
+
+	return w, nil
+}
@@ -14,15 +14,23 @@
 package main
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	current "github.com/containernetworking/cni/pkg/types/100"
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
 	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestParseBlockDevices(t *testing.T) {
@@ -74,6 +82,67 @@ func TestParseBlockDevices(t *testing.T) {
 				return a == nil
 			},
 		},
+		{
+			name: "valid DSL drive",
+			in:   []string{"id=2,path=" + tempFile.Name() + ",readonly=false"},
+			outDrives: []models.Drive{
+				models.Drive{
+					DriveID:      firecracker.String("2"),
+					PathOnHost:   firecracker.String(tempFile.Name()),
+					IsReadOnly:   firecracker.Bool(false),
+					IsRootDevice: firecracker.Bool(false),
+				},
+			},
+			expectedErr: func(a error) bool {
+				return a == nil
+			},
+		},
+		{
+			name: "DSL drive with partuuid, root, and rate limiter",
+			in:   []string{"path=" + tempFile.Name() + ",root=true,partuuid=UUID,ratelimiter-bw-size=1000,ratelimiter-bw-refill-ms=100"},
+			outDrives: []models.Drive{
+				models.Drive{
+					DriveID:      firecracker.String("2"),
+					PathOnHost:   firecracker.String(tempFile.Name()),
+					IsReadOnly:   firecracker.Bool(false),
+					IsRootDevice: firecracker.Bool(true),
+					Partuuid:     "UUID",
+					RateLimiter: &models.RateLimiter{
+						Bandwidth: &models.TokenBucket{
+							Size:       firecracker.Int64(1000),
+							RefillTime: firecracker.Int64(100),
+						},
+					},
+				},
+			},
+			expectedErr: func(a error) bool {
+				return a == nil
+			},
+		},
+		{
+			name:      "DSL unknown key",
+			in:        []string{"path=" + tempFile.Name() + ",bogus=1"},
+			outDrives: nil,
+			expectedErr: func(a error) bool {
+				return a == unknownDriveKey
+			},
+		},
+		{
+			name:      "DSL malformed readonly value",
+			in:        []string{"path=" + tempFile.Name() + ",readonly=sure"},
+			outDrives: nil,
+			expectedErr: func(a error) bool {
+				return a == malformedKeyValue
+			},
+		},
+		{
+			name:      "duplicate drive ids",
+			in:        []string{"id=2,path=" + tempFile.Name(), "id=2,path=" + tempFile.Name()},
+			outDrives: nil,
+			expectedErr: func(a error) bool {
+				return a == duplicateDriveID
+			},
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -95,55 +164,91 @@ func TestParseBlockDevices(t *testing.T) {
 
 func TestParseNicConfig(t *testing.T) {
 	cases := []struct {
-		name      string
-		in        string
-		outDevice string
-		outMac    string
-		outError  error
+		name     string
+		in       string
+		outSpec  nicSpec
+		outError error
 	}{
 		{
-			name:      "valid nic config",
-			in:        "a/b",
-			outDevice: "a",
-			outMac:    "b",
-			outError:  nil,
+			name:     "valid legacy nic config",
+			in:       "a/b",
+			outSpec:  nicSpec{Device: "a", Mac: "b"},
+			outError: nil,
+		},
+		{
+			name:     "legacy no macaddr",
+			in:       "a/",
+			outSpec:  nicSpec{},
+			outError: parseNicConfigError,
+		},
+		{
+			name:     "legacy no separater",
+			in:       "ab",
+			outSpec:  nicSpec{},
+			outError: parseNicConfigError,
+		},
+		{
+			name:     "empty nic config",
+			in:       "",
+			outSpec:  nicSpec{},
+			outError: parseNicConfigError,
+		},
+		{
+			name:     "valid DSL nic config",
+			in:       "device=tap0,mac=AA:BB:CC:DD:EE:FF",
+			outSpec:  nicSpec{Device: "tap0", Mac: "AA:BB:CC:DD:EE:FF"},
+			outError: nil,
+		},
+		{
+			name: "DSL nic config with mtu, allow-mmds, and rate limiters",
+			in:   "device=tap0,mac=AA:BB:CC:DD:EE:FF,mtu=1500,allow-mmds=true,rx-rate=1000,tx-rate=2000",
+			outSpec: nicSpec{
+				Device:    "tap0",
+				Mac:       "AA:BB:CC:DD:EE:FF",
+				Mtu:       1500,
+				AllowMDDS: true,
+				RxRateLimiter: &models.RateLimiter{
+					Bandwidth: &models.TokenBucket{Size: firecracker.Int64(1000)},
+				},
+				TxRateLimiter: &models.RateLimiter{
+					Bandwidth: &models.TokenBucket{Size: firecracker.Int64(2000)},
+				},
+			},
+			outError: nil,
 		},
 		{
-			name:      "no macaddr",
-			in:        "a/",
-			outDevice: "",
-			outMac:    "",
-			outError:  parseNicConfigError,
+			name:     "DSL missing mac",
+			in:       "device=tap0",
+			outSpec:  nicSpec{},
+			outError: parseNicConfigError,
 		},
 		{
-			name:      "no separater",
-			in:        "ab",
-			outDevice: "",
-			outMac:    "",
-			outError:  parseNicConfigError,
+			name:     "DSL unknown key",
+			in:       "device=tap0,mac=a,bogus=1",
+			outSpec:  nicSpec{},
+			outError: unknownNicKey,
 		},
 		{
-			name:      "empty nic config",
-			in:        "",
-			outDevice: "",
-			outMac:    "",
-			outError:  parseNicConfigError,
+			name:     "DSL malformed mtu",
+			in:       "device=tap0,mac=a,mtu=notanumber",
+			outSpec:  nicSpec{},
+			outError: malformedKeyValue,
+		},
+		{
+			name:     "DSL malformed key=value pair",
+			in:       "device=tap0,mac",
+			outSpec:  nicSpec{},
+			outError: malformedKeyValue,
 		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			device, macaddr, err := parseNicConfig(c.in)
-			if device != c.outDevice {
-				t.Errorf("expected device %s but got %s for input %s",
-					c.outDevice,
-					device,
-					c.in)
-			}
-			if macaddr != c.outMac {
-				t.Errorf("expected macaddr %s but got %s for input %s",
-					c.outMac,
-					macaddr,
+			spec, err := parseNicConfig(c.in)
+			if !reflect.DeepEqual(spec, c.outSpec) {
+				t.Errorf("expected %+v but got %+v for input %s",
+					c.outSpec,
+					spec,
 					c.in)
 			}
 			if err != c.outError {
@@ -160,16 +265,30 @@ func TestParseVsocks(t *testing.T) {
 	cases := []struct {
 		name        string
 		in          []string
-		outDevices  []firecracker.VsockDevice
+		outSpecs    []vsockSpec
 		expectedErr func(a error) bool
 	}{
 		{
 			name: "valid input",
-			in:   []string{"a:3"},
-			outDevices: []firecracker.VsockDevice{
-				firecracker.VsockDevice{
-					Path: "a",
+			in:   []string{"path=a,cid=3"},
+			outSpecs: []vsockSpec{
+				{Path: "a", CID: uint32(3)},
+			},
+			expectedErr: func(a error) bool {
+				return a == nil
+			},
+		},
+		{
+			name: "valid input with forwarding rules",
+			in:   []string{"path=/run/v.sock,cid=3,forward=tcp:127.0.0.1:2222->guest:22,forward=unix:/run/app.sock->guest:5000"},
+			outSpecs: []vsockSpec{
+				{
+					Path: "/run/v.sock",
 					CID:  uint32(3),
+					Forwards: []forwardRule{
+						{Network: "tcp", HostAddr: "127.0.0.1:2222", GuestPort: 22},
+						{Network: "unix", HostAddr: "/run/app.sock", GuestPort: 5000},
+					},
 				},
 			},
 			expectedErr: func(a error) bool {
@@ -177,45 +296,69 @@ func TestParseVsocks(t *testing.T) {
 			},
 		},
 		{
-			name:       "no CID",
-			in:         []string{"a3:"},
-			outDevices: []firecracker.VsockDevice{},
+			name:     "no CID",
+			in:       []string{"path=a"},
+			outSpecs: []vsockSpec{},
 			expectedErr: func(a error) bool {
 				return a == unableToParseVsockDevices
 			},
 		},
 		{
-			name:       "empty vsock",
-			in:         []string{""},
-			outDevices: []firecracker.VsockDevice{},
+			name:     "empty vsock",
+			in:       []string{""},
+			outSpecs: []vsockSpec{},
 			expectedErr: func(a error) bool {
 				return a == unableToParseVsockDevices
 			},
 		},
 		{
-			name:       "non-number CID",
-			in:         []string{"a:b"},
-			outDevices: []firecracker.VsockDevice{},
+			name:     "non-number CID",
+			in:       []string{"path=a,cid=b"},
+			outSpecs: []vsockSpec{},
 			expectedErr: func(a error) bool {
 				return a == unableToParseVsockCID
 			},
 		},
 		{
-			name:       "no separator",
-			in:         []string{"ae"},
-			outDevices: []firecracker.VsockDevice{},
+			name:     "no separator",
+			in:       []string{"ae"},
+			outSpecs: []vsockSpec{},
 			expectedErr: func(a error) bool {
 				return a == unableToParseVsockDevices
 			},
 		},
+		{
+			name:     "forward rule missing arrow",
+			in:       []string{"path=a,cid=3,forward=tcp:127.0.0.1:2222guest:22"},
+			outSpecs: []vsockSpec{},
+			expectedErr: func(a error) bool {
+				return a == unableToParseForwardRule
+			},
+		},
+		{
+			name:     "forward rule bad protocol",
+			in:       []string{"path=a,cid=3,forward=ftp:127.0.0.1:2222->guest:22"},
+			outSpecs: []vsockSpec{},
+			expectedErr: func(a error) bool {
+				return a == unableToParseForwardProto
+			},
+		},
+		{
+			name:     "forward rule bad port",
+			in:       []string{"path=a,cid=3,forward=tcp:127.0.0.1:2222->guest:notaport"},
+			outSpecs: []vsockSpec{},
+			expectedErr: func(a error) bool {
+				return a == unableToParseForwardPort
+			},
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			devices, err := parseVsocks(c.in)
-			if !reflect.DeepEqual(devices, c.outDevices) {
-				t.Errorf("expected %v but got %v for %s",
-					c.outDevices,
-					devices,
+			specs, err := parseVsocks(c.in)
+			if !reflect.DeepEqual(specs, c.outSpecs) {
+				t.Errorf("expected %+v but got %+v for %s",
+					c.outSpecs,
+					specs,
 					c.in)
 			}
 			if !c.expectedErr(err) {
@@ -225,8 +368,97 @@ func TestParseVsocks(t *testing.T) {
 	}
 }
 
+// TestVsockProxyRoundTrip proves the proxy wiring: bytes written on the
+// host-facing listener are delivered, after a CONNECT/OK handshake
+// against the base vsock UDS, to whatever is standing in for the guest
+// side, and the reply comes back the other way.
+func TestVsockProxyRoundTrip(t *testing.T) {
+	udsDir, err := ioutil.TempDir("", "firectl-vsock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(udsDir)
+
+	udsPath := udsDir + "/v.sock"
+	guestPort := uint32(22)
+
+	// Stand in for Firecracker's vsock UDS multiplexer: accept the
+	// connection on the base socket, read the CONNECT handshake, reply
+	// OK, then echo whatever follows.
+	fakeMux, err := net.Listen("unix", udsPath)
+	if err != nil {
+		t.Fatalf("listening on fake mux socket: %v", err)
+	}
+	defer fakeMux.Close()
+
+	echoDone := make(chan struct{})
+	go func() {
+		defer close(echoDone)
+		conn, err := fakeMux.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if line != fmt.Sprintf("CONNECT %d\n", guestPort) {
+			conn.Write([]byte("ERROR unexpected handshake\n"))
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("OK %d\n", guestPort)))
+
+		io.Copy(conn, r)
+	}()
+
+	proxy, err := startVsockProxy(udsPath, forwardRule{
+		Network:   "tcp",
+		HostAddr:  "127.0.0.1:0",
+		GuestPort: guestPort,
+	})
+	if err != nil {
+		t.Fatalf("startVsockProxy: %v", err)
+	}
+	defer proxy.Close()
+
+	hostAddr := proxy.(*vsockProxy).ln.Addr().String()
+	conn, err := net.Dial("tcp", hostAddr)
+	if err != nil {
+		t.Fatalf("dialing proxy: %v", err)
+	}
+	defer conn.Close()
+
+	want := "hello vsock"
+	if _, err := conn.Write([]byte(want)); err != nil {
+		t.Fatalf("writing to proxy: %v", err)
+	}
+
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("reading echo from proxy: %v", err)
+	}
+	if string(buf) != want {
+		t.Errorf("expected echo %q, got %q", want, string(buf))
+	}
+
+	// Closing the host side ends the proxy's copy, which closes its
+	// connection to the fake mux and lets the echo goroutine finish.
+	conn.Close()
+	<-echoDone
+}
+
 func TestHandleFifos(t *testing.T) {
 	validateTrue := func(options) bool { return true }
+
+	jailerChrootBase, err := ioutil.TempDir("", "firectl-test-jailer-fifos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(jailerChrootBase)
+
 	cases := []struct {
 		name         string
 		opt          options
@@ -311,8 +543,66 @@ func TestHandleFifos(t *testing.T) {
 					strings.HasSuffix(opt.FcMetricsFifo, "fc_metrics_fifo")
 			},
 		},
+		{
+			name: "metrics-listen set installs a metrics reader and server",
+			opt: options{
+				FcMetricsListen: "127.0.0.1:0",
+			},
+			outWriterNil: true,
+			expectedErr: func(e error) (bool, error) {
+				return e == nil, nil
+			},
+			numClosers: 4, // log fifo + metrics fifo + metrics reader + metrics server
+			validate: func(opt options) bool {
+				f, err := os.OpenFile(opt.FcMetricsFifo, os.O_WRONLY, 0)
+				if err != nil {
+					t.Errorf("opening metrics fifo for writing: %v", err)
+					return false
+				}
+				defer f.Close()
+
+				before := testutil.ToFloat64(firecrackerMetric.WithLabelValues("put_api_requests.count"))
+				if _, err := f.WriteString(`{"put_api_requests":{"count":3}}` + "\n"); err != nil {
+					t.Errorf("writing metrics sample: %v", err)
+					return false
+				}
+
+				deadline := time.Now().Add(2 * time.Second)
+				for time.Now().Before(deadline) {
+					if testutil.ToFloat64(firecrackerMetric.WithLabelValues("put_api_requests.count")) > before {
+						return true
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+				return false
+			},
+		},
+		{
+			name: "jailer configured rewrites fifos into the chroot",
+			opt: options{
+				FcVMID: "test-vm",
+				Jailer: jailerConfig{
+					BinPath:       "/usr/bin/jailer",
+					ChrootBaseDir: jailerChrootBase,
+				},
+			},
+			outWriterNil: true,
+			expectedErr: func(e error) (bool, error) {
+				return e == nil, nil
+			},
+			numClosers: 4, // log fifo + metrics fifo + 2 chroot hardlinks
+			validate: func(opt options) bool {
+				return opt.FcLogFifo == "/vmm-log-fifo" &&
+					opt.FcMetricsFifo == "/vmm-metrics-fifo"
+			},
+		},
 	}
 	for _, c := range cases {
+		if c.opt.Jailer.BinPath != "" {
+			if err := os.MkdirAll(c.opt.jailerChrootDir(), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
 		t.Run(c.name, func(t *testing.T) {
 			w, e := c.opt.handleFifos()
 			if (w == nil && !c.outWriterNil) || (w != nil && c.outWriterNil) {
@@ -354,7 +644,7 @@ func TestGetFirecrackerNetworkingConfig(t *testing.T) {
 		{
 			name: "non-empty but invalid FcNicConfig",
 			opt: options{
-				FcNicConfig: "invalid",
+				FcNicConfig: []string{"invalid"},
 			},
 			expectedErr: func(e error) (bool, error) {
 				return e == parseNicConfigError, parseNicConfigError
@@ -364,7 +654,7 @@ func TestGetFirecrackerNetworkingConfig(t *testing.T) {
 		{
 			name: "valid FcNicConfig with mdds set to true",
 			opt: options{
-				FcNicConfig:   "valid/things",
+				FcNicConfig:   []string{"valid/things"},
 				validMetadata: 42,
 			},
 			expectedErr: func(e error) (bool, error) {
@@ -381,7 +671,7 @@ func TestGetFirecrackerNetworkingConfig(t *testing.T) {
 		{
 			name: "valid FcNicConfig with mdds set to false",
 			opt: options{
-				FcNicConfig: "valid/things",
+				FcNicConfig: []string{"valid/things"},
 			},
 			expectedErr: func(e error) (bool, error) {
 				return e == nil, nil
@@ -394,6 +684,41 @@ func TestGetFirecrackerNetworkingConfig(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "valid DSL FcNicConfig with rate limiters",
+			opt: options{
+				FcNicConfig: []string{"device=tap0,mac=AA:BB,allow-mmds=true,rx-rate=1000,tx-rate=2000"},
+			},
+			expectedErr: func(e error) (bool, error) {
+				return e == nil, nil
+			},
+			expectedNic: []firecracker.NetworkInterface{
+				firecracker.NetworkInterface{
+					MacAddress:  "AA:BB",
+					HostDevName: "tap0",
+					AllowMDDS:   true,
+					InRateLimiter: &models.RateLimiter{
+						Bandwidth: &models.TokenBucket{Size: firecracker.Int64(1000)},
+					},
+					OutRateLimiter: &models.RateLimiter{
+						Bandwidth: &models.TokenBucket{Size: firecracker.Int64(2000)},
+					},
+				},
+			},
+		},
+		{
+			name: "multiple nics",
+			opt: options{
+				FcNicConfig: []string{"tap0/AA:AA", "tap1/BB:BB"},
+			},
+			expectedErr: func(e error) (bool, error) {
+				return e == nil, nil
+			},
+			expectedNic: []firecracker.NetworkInterface{
+				firecracker.NetworkInterface{MacAddress: "AA:AA", HostDevName: "tap0"},
+				firecracker.NetworkInterface{MacAddress: "BB:BB", HostDevName: "tap1"},
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -409,6 +734,110 @@ func TestGetFirecrackerNetworkingConfig(t *testing.T) {
 	}
 }
 
+// TestGetNetworkAppliesMtu proves --nic mtu= actually reaches the host tap
+// device (via setNicMtu) instead of being silently dropped after parsing.
+func TestGetNetworkAppliesMtu(t *testing.T) {
+	originalSetNicMtu := setNicMtu
+	defer func() { setNicMtu = originalSetNicMtu }()
+
+	type mtuCall struct {
+		device string
+		mtu    int
+	}
+	var calls []mtuCall
+	setNicMtu = func(device string, mtu int) error {
+		calls = append(calls, mtuCall{device, mtu})
+		return nil
+	}
+
+	opt := options{
+		FcNicConfig: []string{"device=tap0,mac=AA:BB,mtu=1500", "tap1/CC:CC"},
+	}
+	if _, err := opt.getNetwork(); err != nil {
+		t.Fatalf("getNetwork: %v", err)
+	}
+
+	want := []mtuCall{{"tap0", 1500}}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected setNicMtu calls %v, got %v", want, calls)
+	}
+}
+
+// TestGetNetworkMtuError proves a failure applying the MTU surfaces as an
+// error from getNetwork rather than being ignored.
+func TestGetNetworkMtuError(t *testing.T) {
+	originalSetNicMtu := setNicMtu
+	defer func() { setNicMtu = originalSetNicMtu }()
+
+	wantErr := errors.New("no such tap device")
+	setNicMtu = func(device string, mtu int) error { return wantErr }
+
+	opt := options{FcNicConfig: []string{"device=tap0,mac=AA:BB,mtu=1500"}}
+	if _, err := opt.getNetwork(); err != wantErr {
+		t.Errorf("expected %v but got %v", wantErr, err)
+	}
+}
+
+func TestSelectCNIResult(t *testing.T) {
+	ifaces := []*current.Interface{
+		{Name: "vethhost123", Mac: "AA:AA:AA:AA:AA:AA", Sandbox: ""},
+		{Name: "eth0", Mac: "BB:BB:BB:BB:BB:BB", Sandbox: "/proc/1234/ns/net"},
+	}
+
+	hostDevName, mac := selectCNIResult(ifaces, "eth0")
+	if hostDevName != "vethhost123" {
+		t.Errorf("expected host-side interface %q but got %q", "vethhost123", hostDevName)
+	}
+	if mac != "BB:BB:BB:BB:BB:BB" {
+		t.Errorf("expected guest MAC %q but got %q", "BB:BB:BB:BB:BB:BB", mac)
+	}
+}
+
+func TestGetFirecrackerNetworkingConfigWithCNI(t *testing.T) {
+	originalSetup := cniNetworkSetup
+	defer func() { cniNetworkSetup = originalSetup }()
+
+	var gotContainerID string
+	var gotSpec cniSpec
+	cniNetworkSetup = func(containerID string, spec cniSpec) (firecracker.NetworkInterface, io.Closer, error) {
+		gotContainerID = containerID
+		gotSpec = spec
+		return firecracker.NetworkInterface{
+			MacAddress:  "CC:CC:CC:CC:CC:CC",
+			HostDevName: "vethmocked",
+		}, ioutil.NopCloser(nil), nil
+	}
+
+	opt := options{
+		FcNicConfig:  []string{"tap0/AA:AA"},
+		FcCNINetworks: []string{"network=testbridge,ifname=eth0"},
+		FcVMID:       "test-vm",
+	}
+
+	nic, err := opt.getNetwork()
+	if err != nil {
+		t.Fatalf("getNetwork: %v", err)
+	}
+
+	expected := []firecracker.NetworkInterface{
+		{MacAddress: "AA:AA", HostDevName: "tap0"},
+		{MacAddress: "CC:CC:CC:CC:CC:CC", HostDevName: "vethmocked"},
+	}
+	if !reflect.DeepEqual(nic, expected) {
+		t.Errorf("expected %v but got %v", expected, nic)
+	}
+
+	if gotContainerID != "test-vm" {
+		t.Errorf("expected containerID %q, got %q", "test-vm", gotContainerID)
+	}
+	if gotSpec.Network != "testbridge" || gotSpec.IfName != "eth0" {
+		t.Errorf("unexpected CNI spec passed to cniNetworkSetup: %+v", gotSpec)
+	}
+	if len(opt.closers) != 1 {
+		t.Errorf("expected the CNI teardown to be registered as a closer, got %d closers", len(opt.closers))
+	}
+}
+
 func TestGetBlockDevices(t *testing.T) {
 	tempFile, err := ioutil.TempFile("", "firectl-test-drive-path")
 	if err != nil {
@@ -459,6 +888,25 @@ func TestGetBlockDevices(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "DSL drive declaring itself root skips the legacy root drive",
+			opt: options{
+				FcAdditionalDrives: []string{"path=" + tempFile.Name() + ",root=true,partuuid=UUID"},
+				FcRootDrivePath:    "/should/not/be/used",
+			},
+			expectedErr: func(e error) (bool, error) {
+				return e == nil, nil
+			},
+			expectedDrives: []models.Drive{
+				models.Drive{
+					DriveID:      firecracker.String("2"),
+					PathOnHost:   firecracker.String(tempFile.Name()),
+					IsReadOnly:   firecracker.Bool(false),
+					IsRootDevice: firecracker.Bool(true),
+					Partuuid:     "UUID",
+				},
+			},
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -472,3 +920,59 @@ func TestGetBlockDevices(t *testing.T) {
 		})
 	}
 }
+
+// TestGetBlockDevicesWithJailer covers getBlockDevices' chroot rewriting:
+// with a jailer configured, PathOnHost should be rewritten to the
+// in-chroot path, with the backing file hardlinked into a fake chroot dir.
+func TestGetBlockDevicesWithJailer(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "firectl-test-jailer-drive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	chrootBase, err := ioutil.TempDir("", "firectl-test-jailer-chroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(chrootBase)
+
+	opt := options{
+		FcAdditionalDrives: []string{tempFile.Name() + ":ro"},
+		FcRootDrivePath:    tempFile.Name(),
+		FcVMID:             "test-vm",
+		Jailer: jailerConfig{
+			BinPath:       "/usr/bin/jailer",
+			ChrootBaseDir: chrootBase,
+		},
+	}
+	defer opt.Close()
+
+	if err := os.MkdirAll(opt.jailerChrootDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the additional drive and the root drive point at the same
+	// host file (tempFile), which would collide if the in-chroot name
+	// were keyed by basename instead of drive id.
+	drives, err := opt.getBlockDevices()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(drives) != 2 {
+		t.Fatalf("expected 2 drives but got %d", len(drives))
+	}
+
+	for _, d := range drives {
+		expected := "/drive-" + *d.DriveID
+		if *d.PathOnHost != expected {
+			t.Errorf("expected PathOnHost %q but got %q", expected, *d.PathOnHost)
+		}
+
+		if _, err := os.Stat(filepath.Join(opt.jailerChrootDir(), expected)); err != nil {
+			t.Errorf("expected drive %s to be hardlinked into chroot: %v", *d.DriveID, err)
+		}
+	}
+}
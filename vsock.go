@@ -0,0 +1,268 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//	http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	unableToParseVsockDevices = errors.New("unable to parse vsock devices, should be: path=PATH,cid=CID[,forward=...]")
+	unableToParseVsockCID     = errors.New("unable to parse vsock CID, should be a positive integer")
+	unableToParseForwardRule  = errors.New("unable to parse forward rule, should be: PROTO:HOSTADDR->guest:PORT")
+	unableToParseForwardProto = errors.New("unable to parse forward rule protocol, should be tcp or unix")
+	unableToParseForwardPort  = errors.New("unable to parse forward rule guest port")
+	vsockHandshakeRejected    = errors.New("guest rejected vsock CONNECT handshake")
+)
+
+// forwardRule describes one host-to-guest vsock port forward: connections
+// accepted on the host (over Network/HostAddr) are proxied to GuestPort on
+// the guest, over AF_VSOCK.
+type forwardRule struct {
+	Network   string // "tcp" or "unix"
+	HostAddr  string
+	GuestPort uint32
+}
+
+// parseForwardRule decodes a "PROTO:HOSTADDR->guest:PORT" forwarding rule,
+// e.g. "tcp:127.0.0.1:2222->guest:22" or "unix:/run/app.sock->guest:5000".
+func parseForwardRule(v string) (forwardRule, error) {
+	sides := strings.SplitN(v, "->", 2)
+	if len(sides) != 2 {
+		return forwardRule{}, unableToParseForwardRule
+	}
+
+	guestPort := strings.TrimPrefix(sides[1], "guest:")
+	if guestPort == sides[1] {
+		return forwardRule{}, unableToParseForwardRule
+	}
+	port, err := strconv.ParseUint(guestPort, 10, 32)
+	if err != nil {
+		return forwardRule{}, unableToParseForwardPort
+	}
+
+	host := strings.SplitN(sides[0], ":", 2)
+	if len(host) != 2 {
+		return forwardRule{}, unableToParseForwardRule
+	}
+
+	switch host[0] {
+	case "tcp", "unix":
+	default:
+		return forwardRule{}, unableToParseForwardProto
+	}
+
+	return forwardRule{Network: host[0], HostAddr: host[1], GuestPort: uint32(port)}, nil
+}
+
+// vsockSpec is the decoded form of a --vsock-device specification:
+// "path=PATH,cid=CID[,forward=PROTO:HOSTADDR->guest:PORT]...".
+type vsockSpec struct {
+	Path     string
+	CID      uint32
+	Forwards []forwardRule
+}
+
+// parseVsockSpec decodes one --vsock-device entry.
+func parseVsockSpec(entry string) (vsockSpec, error) {
+	var spec vsockSpec
+	var havePath, haveCID bool
+
+	for _, kv := range strings.Split(entry, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return vsockSpec{}, unableToParseVsockDevices
+		}
+
+		switch parts[0] {
+		case "path":
+			spec.Path = parts[1]
+			havePath = true
+		case "cid":
+			cid, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				return vsockSpec{}, unableToParseVsockCID
+			}
+			spec.CID = uint32(cid)
+			haveCID = true
+		case "forward":
+			rule, err := parseForwardRule(parts[1])
+			if err != nil {
+				return vsockSpec{}, err
+			}
+			spec.Forwards = append(spec.Forwards, rule)
+		default:
+			return vsockSpec{}, unableToParseVsockDevices
+		}
+	}
+
+	if !havePath || !haveCID {
+		return vsockSpec{}, unableToParseVsockDevices
+	}
+
+	return spec, nil
+}
+
+// parseVsocks decodes a list of --vsock-device specifications.
+func parseVsocks(entries []string) ([]vsockSpec, error) {
+	specs := []vsockSpec{}
+
+	for _, entry := range entries {
+		spec, err := parseVsockSpec(entry)
+		if err != nil {
+			return specs, err
+		}
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
+// dialVsock opens a host-initiated connection to guestPort over
+// Firecracker's vsock UDS multiplexer at udsPath. Per Firecracker's vsock
+// device protocol, the host dials udsPath itself (not a per-port path) and
+// sends "CONNECT <port>\n"; the guest side replies with "OK <port>\n" once
+// it accepts, after which the connection carries the forwarded bytes
+// directly.
+func dialVsock(udsPath string, guestPort uint32) (net.Conn, error) {
+	conn, err := net.Dial("unix", udsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", guestPort); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending vsock CONNECT handshake: %v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	reply, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading vsock CONNECT reply: %v", err)
+	}
+	if !strings.HasPrefix(reply, "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", vsockHandshakeRejected, strings.TrimSpace(reply))
+	}
+
+	return &handshakedVsockConn{Conn: conn, r: r}, nil
+}
+
+// handshakedVsockConn is a net.Conn whose Read draws from r instead of the
+// raw connection, so bytes bufio.Reader buffered while reading the CONNECT
+// reply aren't lost.
+type handshakedVsockConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *handshakedVsockConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// vsockProxy listens on the host side of one forwardRule and proxies
+// accepted connections to the guest over Firecracker's vsock UDS
+// multiplexer, until Close is called.
+type vsockProxy struct {
+	ln net.Listener
+}
+
+func (p *vsockProxy) Close() error {
+	return p.ln.Close()
+}
+
+func (p *vsockProxy) serve(udsPath string, guestPort uint32) {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		go proxyVsockConn(conn, udsPath, guestPort)
+	}
+}
+
+func proxyVsockConn(hostConn net.Conn, udsPath string, guestPort uint32) {
+	defer hostConn.Close()
+
+	guestConn, err := dialVsock(udsPath, guestPort)
+	if err != nil {
+		log.Warnf("vsock forward to guest port %d: %v", guestPort, err)
+		return
+	}
+	defer guestConn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(guestConn, hostConn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(hostConn, guestConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// startVsockProxy listens on rule's host side and begins proxying
+// connections to udsPath/GuestPort, returning an io.Closer that stops it.
+func startVsockProxy(udsPath string, rule forwardRule) (io.Closer, error) {
+	ln, err := net.Listen(rule.Network, rule.HostAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s %s: %v", rule.Network, rule.HostAddr, err)
+	}
+
+	proxy := &vsockProxy{ln: ln}
+	go proxy.serve(udsPath, rule.GuestPort)
+
+	return proxy, nil
+}
+
+// getVsocks resolves opt.FcVsockDevices into the firecracker.VsockDevice
+// list, starting a vsockProxy sidecar (tracked via opt.closers) for every
+// forwarding rule along the way.
+func (opt *options) getVsocks() ([]firecracker.VsockDevice, error) {
+	specs, err := parseVsocks(opt.FcVsockDevices)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []firecracker.VsockDevice{}
+	for _, spec := range specs {
+		for _, rule := range spec.Forwards {
+			proxy, err := startVsockProxy(spec.Path, rule)
+			if err != nil {
+				return nil, err
+			}
+			opt.closers = append(opt.closers, proxy)
+		}
+
+		devices = append(devices, firecracker.VsockDevice{
+			Path: spec.Path,
+			CID:  spec.CID,
+		})
+	}
+
+	return devices, nil
+}